@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/fs/rc"
 )
 
 // Node represents either a *Dir or a *File
@@ -20,6 +21,15 @@ type Node interface {
 	Remove() error
 	RemoveAll() error
 	DirEntry() fs.DirEntry
+	// Object returns the fs.Object backing a file, or nil for a directory.
+	// Readers must go through this rather than reaching into a *File
+	// directly, so that wrapper nodes (for example a Snapshot) can swap
+	// in a different fs.Object without the reader knowing.
+	Object() fs.Object
+	Getxattr(name string) ([]byte, error)
+	Setxattr(name string, value []byte) error
+	Listxattr() ([]string, error)
+	Removexattr(name string) error
 }
 
 var (
@@ -51,19 +61,27 @@ var (
 // FS represents the top level filing system
 type FS struct {
 	f            fs.Fs
+	name         string // name this FS is registered under with rc.AddVFS
 	root         *Dir
-	noSeek       bool          // don't allow seeking if set
-	noChecksum   bool          // don't check checksums if set
-	readOnly     bool          // if set FS is read only
-	noModTime    bool          // don't read mod times for files
-	dirCacheTime time.Duration // how long to consider directory listing cache valid
+	noSeek       bool              // don't allow seeking if set
+	noChecksum   bool              // don't check checksums if set
+	readOnly     bool              // if set FS is read only
+	noModTime    bool              // don't read mod times for files
+	dirCacheTime time.Duration     // how long to consider directory listing cache valid
+	invalidator  Invalidator       // mount backend to notify of kernel cache invalidations, if any
+	statfsCache  statfsCache       // cached result of the last Statfs call
+	journal      *writebackJournal // durable write-back journal, if CacheDir is set
+	lastPollNano int64             // atomic: UnixNano of the last notifyChange, 0 if never polled
 }
 
+var _ rc.VFS = (*FS)(nil)
+
 // NewFS creates a new filing system and root directory
 func NewFS(f fs.Fs) *FS {
 	fsDir := fs.NewDir("", time.Now())
 	fsys := &FS{
-		f: f,
+		f:    f,
+		name: f.String(),
 	}
 
 	if NoSeek {
@@ -82,23 +100,98 @@ func NewFS(f fs.Fs) *FS {
 
 	fsys.root = newDir(fsys, f, nil, fsDir)
 
+	if CacheDir != "" {
+		journal, err := openWritebackJournal(CacheDir)
+		if err != nil {
+			fs.Errorf(f, "failed to open write-back journal: %v", err)
+		} else {
+			fsys.journal = journal
+			if err := fsys.resumeWritebacks(); err != nil {
+				fs.Errorf(f, "failed to replay write-back journal: %v", err)
+			}
+		}
+	}
+
 	if PollInterval > 0 {
 		fsys.PollChanges(PollInterval)
 	}
+
+	rc.AddVFS(fsys.name, fsys)
 	return fsys
 }
 
+// Unmount deregisters fsys from the vfs/* rc calls and closes its
+// write-back journal, if one is open. Mount backends should call this once
+// the kernel has released the mount.
+func (fsys *FS) Unmount() error {
+	rc.RemoveVFS(fsys.name)
+	if fsys.journal == nil {
+		return nil
+	}
+	return fsys.journal.Close()
+}
+
 // PollChanges will poll the remote every pollInterval for changes if the remote
 // supports it. If a non-polling option is used, the given time interval can be
 // ignored
 func (fsys *FS) PollChanges(pollInterval time.Duration) *FS {
 	doDirChangeNotify := fsys.f.Features().DirChangeNotify
 	if doDirChangeNotify != nil {
-		doDirChangeNotify(fsys.root.ForgetPath, pollInterval)
+		doDirChangeNotify(fsys.notifyChange, pollInterval)
 	}
 	return fsys
 }
 
+// notifyChange is called by a remote's DirChangeNotify for every path that
+// has changed. It forgets the in-process Dir cache for path and, if a mount
+// backend has registered an Invalidator, pushes the invalidation down into
+// the kernel as well: InvalidateEntry drops path's dentry from its parent
+// directory so it is looked up again, and InvalidateInode drops any cached pages the kernel is
+// holding for path itself, so a file that's already open (or mmap'd) picks
+// up the new content instead of continuing to serve stale pages.
+func (fsys *FS) notifyChange(path string) {
+	atomic.StoreInt64(&fsys.lastPollNano, time.Now().UnixNano())
+
+	// Look up the node - and capture the inode the kernel actually has
+	// cached for path - before ForgetPath evicts it. Looking it up again
+	// afterwards would hand InvalidateInode a freshly minted inode number
+	// from NewInode that the kernel has never seen, making the call a
+	// no-op.
+	var changedInode uint64
+	changed, lookupErr := fsys.Lookup(path)
+	if lookupErr == nil {
+		changedInode = changed.Inode()
+	}
+
+	fsys.root.ForgetPath(path)
+	if fsys.invalidator == nil {
+		return
+	}
+	parent, name := splitInvalidatePath(path)
+	parentNode, err := fsys.Lookup(parent)
+	if err != nil {
+		return
+	}
+	if err := fsys.invalidator.InvalidateEntry(parentNode.Inode(), name); err != nil {
+		fs.Debugf(fsys.f, "InvalidateEntry(%q): %v", path, err)
+	}
+	if lookupErr == nil {
+		if err := fsys.invalidator.InvalidateInode(changedInode); err != nil {
+			fs.Debugf(fsys.f, "InvalidateInode(%q): %v", path, err)
+		}
+	}
+}
+
+// splitInvalidatePath splits path into its parent directory and leaf name
+// for use with Invalidator.InvalidateEntry.
+func splitInvalidatePath(path string) (parent, name string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
 // Root returns the root node
 func (fsys *FS) Root() (*Dir, error) {
 	// fs.Debugf(fsys.f, "Root()")
@@ -139,20 +232,61 @@ func (fsys *FS) Lookup(path string) (node Node, err error) {
 	return
 }
 
-// Statfs is called to obtain file system metadata.
-// It should write that data to resp.
-func (fsys *FS) Statfs() error {
-	/* FIXME
-	const blockSize = 4096
-	const fsBlocks = (1 << 50) / blockSize
-	resp.Blocks = fsBlocks  // Total data blocks in file system.
-	resp.Bfree = fsBlocks   // Free blocks in file system.
-	resp.Bavail = fsBlocks  // Free blocks in file system if you're not root.
-	resp.Files = 1E9        // Total files in file system.
-	resp.Ffree = 1E9        // Free files in file system.
-	resp.Bsize = blockSize  // Block size
-	resp.Namelen = 255      // Maximum file name length?
-	resp.Frsize = blockSize // Fragment size, smallest addressable data size in the file system.
-	*/
+// Statfs returns file system metadata suitable for the FUSE/NFS statfs
+// call. See statfs.go for how the values are obtained and cached.
+func (fsys *FS) Statfs() (*StatfsInfo, error) {
+	return fsys.statfs()
+}
+
+// VFSStats implements rc.VFS, returning real counters for the write-back
+// journal, the dir cache and the last poll time. CacheSize is always 0 -
+// this FS doesn't yet track the size of an on-disk read cache. OpenHandles
+// counts only write handles; read handles are not counted. LastPoll is the
+// time the last change notification arrived, so a poll that finds no
+// change does not update it.
+func (fsys *FS) VFSStats() rc.VFSStats {
+	openHandles, pendingWriteback := writebackStats(fsys)
+	var lastPoll time.Time
+	if nano := atomic.LoadInt64(&fsys.lastPollNano); nano != 0 {
+		lastPoll = time.Unix(0, nano)
+	}
+	return rc.VFSStats{
+		OpenHandles:      openHandles,
+		DirCacheEntries:  fsys.root.CacheEntries(),
+		PendingWriteback: pendingWriteback,
+		LastPoll:         lastPoll,
+	}
+}
+
+// ForgetPath implements rc.VFS, dropping the in-process dir cache entry for
+// path (or the whole tree if path is "").
+func (fsys *FS) ForgetPath(path string) {
+	fsys.root.ForgetPath(path)
+}
+
+// Refresh implements rc.VFS. It forgets path's cached listing and looks it
+// up again straight away, so the caller gets a synchronous re-read instead
+// of waiting for the next lazy Lookup to notice the cache is gone.
+func (fsys *FS) Refresh(path string) error {
+	fsys.root.ForgetPath(path)
+	node, err := fsys.Lookup(path)
+	if err != nil {
+		return err
+	}
+	if dir, ok := node.(*Dir); ok {
+		_, err = dir.ReadDirAll()
+	}
+	return err
+}
+
+// PollNow implements rc.VFS, re-driving the remote's DirChangeNotify
+// registration to force an out-of-band poll. It reuses PollInterval rather
+// than taking one, so it doesn't change the mount's configured interval.
+func (fsys *FS) PollNow() error {
+	doDirChangeNotify := fsys.f.Features().DirChangeNotify
+	if doDirChangeNotify == nil {
+		return fmt.Errorf("%v: remote doesn't support polling for changes", fsys.f)
+	}
+	doDirChangeNotify(fsys.notifyChange, PollInterval)
 	return nil
 }
@@ -0,0 +1,448 @@
+package mountlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// journalEntry is a single record in the write-back journal. Each record
+// describes the *cumulative* state of one file's spill buffer immediately
+// after a write - Length is the high-water mark of bytes written so far and
+// Crc32 is the checksum of the whole spill file up to Length - rather than
+// just the bytes touched by that one write. That way the most recent
+// pending entry for an inode is always enough on its own to verify and
+// replay the file in full, however many chunks (sequential or out of
+// order) it took to write it.
+type journalEntry struct {
+	Inode  uint64 `json:"inode"`
+	Remote string `json:"remote"` // remote path of the file being written, needed to resume the upload
+	Length int64  `json:"length"` // high-water mark of bytes written to Spill so far
+	Crc32  uint32 `json:"crc32"`  // checksum of Spill[:Length]
+	Spill  string `json:"spill"`  // path of the backing spill file holding the written bytes
+	Done   bool   `json:"done"`   // true once the upload for this inode has completed
+}
+
+// writebackJournal is a durable, append-only log of in-flight writes kept
+// in the VFS cache dir, so NewFS can resume uploads interrupted by a crash
+// or unclean unmount. It is analogous to Syncthing's staged pull pipeline.
+type writebackJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// openWritebackJournal opens (creating if necessary) the journal file
+// under cacheDir.
+func openWritebackJournal(cacheDir string) (*writebackJournal, error) {
+	path := filepath.Join(cacheDir, "writeback.journal")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &writebackJournal{path: path, file: f}, nil
+}
+
+// Record appends a journal entry describing one buffered write.
+func (j *writebackJournal) Record(entry journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.appendLocked(entry)
+}
+
+// appendLocked appends entry to the journal file. Callers must hold j.mu.
+func (j *writebackJournal) appendLocked(entry journalEntry) error {
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// MarkDone appends a tombstone entry recording that the upload for inode is
+// complete, so replay can skip it.
+func (j *writebackJournal) MarkDone(inode uint64) error {
+	return j.Record(journalEntry{Inode: inode, Done: true})
+}
+
+// Replay reads every entry in the journal and returns the set of pending
+// (inode, spill file) pairs that haven't been marked done, in append
+// order. NewFS calls this once at startup to resume interrupted uploads.
+func (j *writebackJournal) Replay() ([]journalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.replayLocked()
+}
+
+// replayLocked does the work of Replay. Callers must hold j.mu.
+func (j *writebackJournal) replayLocked() ([]journalEntry, error) {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	pending := map[uint64]journalEntry{}
+	order := []uint64{}
+	scanner := bufio.NewScanner(j.file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn write at the tail of the journal means rclone crashed
+			// mid-append; ignore the partial record and stop replay here.
+			break
+		}
+		if entry.Done {
+			delete(pending, entry.Inode)
+			continue
+		}
+		if _, ok := pending[entry.Inode]; !ok {
+			order = append(order, entry.Inode)
+		}
+		pending[entry.Inode] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := j.file.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	entries := make([]journalEntry, 0, len(order))
+	for _, inode := range order {
+		entry, ok := pending[inode]
+		if !ok {
+			continue
+		}
+		entries = append(entries, entry)
+		delete(pending, inode)
+	}
+	return entries, nil
+}
+
+// Compact rewrites the journal keeping only entries still pending,
+// dropping completed (inode, done) pairs. It should be called
+// periodically once the number of tombstoned entries grows large.
+//
+// The whole operation holds j.mu, so a Record racing with a Compact either
+// lands in the old file before the swap (and is carried over by
+// replayLocked) or blocks until the swap is done and lands in the new one -
+// it can never be dropped.
+func (j *writebackJournal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries, err := j.replayLocked()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := j.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		data, err := json.Marshal(&entry)
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		if _, err := tmp.Write(append(data, '\n')); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	return nil
+}
+
+// Close closes the underlying journal file.
+func (j *writebackJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// checksum returns the crc32 of data, used to detect a spill file that was
+// only partially written before a crash.
+func checksum(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// writebackState tracks the in-flight spill buffer for one open
+// WriteFileHandle. It is keyed by the handle's own pointer rather than
+// stored as a field on WriteFileHandle, the same way defaultXattrStore
+// keys user xattrs by inode instead of living on Node.
+type writebackState struct {
+	fsys      *FS
+	node      Node
+	highWater int64 // bytes written to spill so far (max offset+len seen)
+	spill     string
+	crc       hash.Hash32 // incremental crc32 of Spill[:highWater], valid only after a sequential append
+}
+
+var (
+	writebackMu     sync.Mutex
+	writebackStates = map[*WriteFileHandle]*writebackState{}
+)
+
+// writebackStats returns the number of write handles fsys currently has
+// buffered, and the total bytes spilled for them, for FS.VFSStats.
+func writebackStats(fsys *FS) (openHandles int, pendingBytes int64) {
+	writebackMu.Lock()
+	defer writebackMu.Unlock()
+	for _, state := range writebackStates {
+		if state.fsys != fsys {
+			continue
+		}
+		openHandles++
+		pendingBytes += state.highWater
+	}
+	return openHandles, pendingBytes
+}
+
+// journalBegin registers node's WriteFileHandle with the journal so
+// subsequent JournalWrite/JournalClose calls know where to spill its data
+// and which FS's journal to record into. Call this from
+// WriteFileHandle's constructor.
+func (fsys *FS) journalBegin(wfh *WriteFileHandle, node Node) {
+	writebackMu.Lock()
+	defer writebackMu.Unlock()
+	writebackStates[wfh] = &writebackState{fsys: fsys, node: node}
+}
+
+// JournalWrite spills data to offset in wfh's backing file and, if fsys has
+// a write-back journal configured, records the new cumulative state of
+// that spill file so the write survives a crash between now and the
+// eventual upload. WriteFileHandle's Write method calls this for every
+// chunk it buffers, at whatever offset the writer supplied (FUSE writes
+// aren't necessarily sequential).
+func (wfh *WriteFileHandle) JournalWrite(data []byte, offset int64) (n int, err error) {
+	writebackMu.Lock()
+	state, ok := writebackStates[wfh]
+	writebackMu.Unlock()
+	if !ok {
+		return len(data), nil
+	}
+
+	if state.spill == "" {
+		spillDir := state.fsys.journalSpillDir()
+		spillFile, err := ioutil.TempFile(spillDir, "writeback-*.spill")
+		if err != nil {
+			return 0, err
+		}
+		state.spill = spillFile.Name()
+		if err := spillFile.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.OpenFile(state.spill, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		_ = f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	oldHighWater := state.highWater
+	if end := offset + int64(len(data)); end > state.highWater {
+		state.highWater = end
+	}
+
+	if state.fsys.journal == nil {
+		return len(data), nil
+	}
+
+	crc, err := state.checksumAfterWrite(oldHighWater, offset, data)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := journalEntry{
+		Inode:  state.node.Inode(),
+		Remote: state.node.DirEntry().Remote(),
+		Length: state.highWater,
+		Crc32:  crc,
+		Spill:  state.spill,
+	}
+	if err := state.fsys.journal.Record(entry); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// checksumAfterWrite returns the crc32 of Spill[:state.highWater] after a
+// write of data at offset extended the spill file from oldHighWater. A
+// write that sequentially appends (offset == oldHighWater, the common case
+// for a file being written start to end) extends the running hash instead
+// of re-reading the whole spill file; any other write pattern (a gap, an
+// overlapping rewrite, or the first write) can't be folded into the
+// running hash, so it's rebuilt once from the file on disk.
+func (state *writebackState) checksumAfterWrite(oldHighWater, offset int64, data []byte) (uint32, error) {
+	if state.crc != nil && offset == oldHighWater {
+		_, _ = state.crc.Write(data)
+		return state.crc.Sum32(), nil
+	}
+
+	spilled, err := ioutil.ReadFile(state.spill)
+	if err != nil {
+		return 0, err
+	}
+	spilled = spilled[:state.highWater]
+	state.crc = crc32.NewIEEE()
+	_, _ = state.crc.Write(spilled)
+	return state.crc.Sum32(), nil
+}
+
+// journalSpillDir returns where to put write-back spill files: the VFS
+// cache dir if one is configured, otherwise the system temp dir.
+func (fsys *FS) journalSpillDir() string {
+	if CacheDir != "" {
+		return CacheDir
+	}
+	return os.TempDir()
+}
+
+// JournalClose is called once WriteFileHandle's upload has completed
+// successfully. It marks the write-back complete in the journal (if one is
+// configured), removes the spill file and compacts the journal to reclaim
+// the tombstoned entries.
+func (wfh *WriteFileHandle) JournalClose() error {
+	writebackMu.Lock()
+	state, ok := writebackStates[wfh]
+	delete(writebackStates, wfh)
+	writebackMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if state.fsys.journal != nil {
+		if err := state.fsys.journal.MarkDone(state.node.Inode()); err != nil {
+			return err
+		}
+	}
+	if state.spill != "" {
+		if err := os.Remove(state.spill); err != nil && !os.IsNotExist(err) {
+			fs.Errorf(state.fsys.f, "failed to remove spill file %q: %v", state.spill, err)
+		}
+	}
+	if state.fsys.journal != nil {
+		if err := state.fsys.journal.Compact(); err != nil {
+			fs.Errorf(state.fsys.f, "failed to compact write-back journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// resumeWritebacks replays the journal for fsys's cache dir (if one is
+// configured) and re-uploads every write that is still pending, so an
+// unclean shutdown or unmount with --vfs-cache-mode writes/full doesn't
+// lose buffered writes.
+func (fsys *FS) resumeWritebacks() error {
+	if fsys.journal == nil {
+		return nil
+	}
+	entries, err := fsys.journal.Replay()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fsys.resumeWriteback(entry); err != nil {
+			fs.Errorf(fsys.f, "failed to resume write to %q: %v", entry.Remote, err)
+			continue
+		}
+		if err := fsys.journal.MarkDone(entry.Inode); err != nil {
+			fs.Errorf(fsys.f, "failed to mark resumed write to %q done: %v", entry.Remote, err)
+		}
+	}
+	return fsys.journal.Compact()
+}
+
+// resumeWriteback re-uploads a single spilled write recovered from the
+// journal, verifying it wasn't torn by the crash before re-driving it.
+func (fsys *FS) resumeWriteback(entry journalEntry) error {
+	data, err := ioutil.ReadFile(entry.Spill)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < entry.Length {
+		return fmt.Errorf("spill file %q is %d bytes, expected at least %d", entry.Spill, len(data), entry.Length)
+	}
+	data = data[:entry.Length]
+	if checksum(data) != entry.Crc32 {
+		return fmt.Errorf("spill file %q failed checksum verification", entry.Spill)
+	}
+
+	if err := uploadSpill(fsys, entry.Remote, data); err != nil {
+		return err
+	}
+	fs.Infof(fsys.f, "resumed interrupted write to %q (%d bytes)", entry.Remote, entry.Length)
+	return os.Remove(entry.Spill)
+}
+
+// readSpill reads back the first highWater bytes spilled to spill by
+// JournalWrite, ready to hand to uploadSpill. WriteFileHandle.Flush calls
+// this on the normal (non-crash-recovery) close path.
+func readSpill(spill string, highWater int64) ([]byte, error) {
+	data, err := ioutil.ReadFile(spill)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < highWater {
+		return nil, fmt.Errorf("spill file %q is %d bytes, expected at least %d", spill, len(data), highWater)
+	}
+	return data[:highWater], nil
+}
+
+// uploadSpill uploads data (a complete file's worth of spilled writes) to
+// remote. It is used both to resume a crashed write (resumeWriteback) and
+// by WriteFileHandle.Flush on the normal close path.
+func uploadSpill(fsys *FS, remote string, data []byte) error {
+	ctx := context.Background()
+	src := fs.NewStaticObjectInfo(remote, time.Now(), int64(len(data)), true, nil, fsys.f)
+	_, err := fsys.f.Put(ctx, bytes.NewReader(data), src)
+	return err
+}
@@ -0,0 +1,40 @@
+package mountlib
+
+import "github.com/ncw/rclone/fs"
+
+// Invalidator is implemented by mount backends (cgofuse, bazil/fuse,
+// go-fuse) that can push cache invalidation down into the kernel. Backends
+// register themselves with FS.SetInvalidator so that remote change
+// notifications picked up by PollChanges actively invalidate the kernel
+// dcache/page cache instead of relying on the in-process Dir cache alone.
+//
+// This mirrors go-fuse's nodefs EntryNotify/InodeNotify pair.
+type Invalidator interface {
+	// InvalidateEntry tells the kernel to forget the dentry "name" in the
+	// directory with inode parent, so a subsequent lookup goes back to
+	// the FS instead of being served from the dcache.
+	InvalidateEntry(parent uint64, name string) error
+	// InvalidateInode tells the kernel to drop any cached pages/attributes
+	// it holds for inode.
+	InvalidateInode(inode uint64) error
+}
+
+// SetInvalidator registers the Invalidator a mount backend uses to push
+// cache invalidation into the kernel. It must be called before PollChanges
+// starts. NewFS starts PollChanges itself when PollInterval is greater than
+// zero, so calling this after NewFS returns only meets that when
+// PollInterval is zero.
+func (fsys *FS) SetInvalidator(invalidator Invalidator) {
+	fsys.invalidator = invalidator
+}
+
+// InvalidateInode asks the kernel to drop its cache for inode, if an
+// Invalidator is registered.
+func (fsys *FS) InvalidateInode(inode uint64) {
+	if fsys.invalidator == nil {
+		return
+	}
+	if err := fsys.invalidator.InvalidateInode(inode); err != nil {
+		fs.Debugf(fsys.f, "InvalidateInode(%d): %v", inode, err)
+	}
+}
@@ -0,0 +1,16 @@
+package mountlib
+
+import "github.com/ncw/rclone/fs"
+
+// Object returns nil - a directory has no backing fs.Object.
+func (d *Dir) Object() fs.Object {
+	return nil
+}
+
+// Object returns the live fs.Object backing f. Readers should call this
+// instead of reaching into f directly, so wrapper Nodes (for example a
+// Snapshot) can swap in a different fs.Object transparently.
+func (f *File) Object() fs.Object {
+	o, _ := f.DirEntry().(fs.Object)
+	return o
+}
@@ -0,0 +1,232 @@
+package mountlib
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// Snapshot returns a Node representing an immutable, copy-on-write view of
+// the subtree rooted at path as it exists at the moment of the call.
+//
+// The fs.DirEntry (and, for files, the fs.Object) backing every node in the
+// returned tree is captured eagerly at snapshot time, so DirEntry, the
+// os.FileInfo accessors and Object all keep reporting the same point-in-time
+// metadata no matter what the live FS does afterwards. Only the actual
+// byte-level read (Open, via Node.Object, which readers must always go
+// through rather than reaching into a *File directly) is deferred. This lets
+// callers (for example an HTTP or WebDAV server) serve a stable
+// point-in-time export of a directory while the live FS keeps being
+// mutated by other writers.
+//
+// Any attempt to write through the snapshot, including setting an xattr,
+// fails with EROFS.
+func (fsys *FS) Snapshot(path string) (Node, error) {
+	node, err := fsys.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshotNode(node)
+}
+
+// newSnapshotNode builds a snapshotDir or snapshotFile wrapping node,
+// recursing into directories to capture their listings at this instant.
+func newSnapshotNode(node Node) (Node, error) {
+	if dir, ok := node.(*Dir); ok {
+		return newSnapshotDir(dir)
+	}
+	return newSnapshotFile(node)
+}
+
+// snapshotFile is an immutable, point-in-time view of a single file.
+//
+// Its fs.DirEntry/fs.Object are captured at construction time, not on first
+// read, so an overwrite of the live file between Snapshot and the first
+// read can't leak through. Opening the object's content is still deferred
+// until Open is actually called, so taking a snapshot of a large tree is
+// cheap.
+type snapshotFile struct {
+	Node
+	entry fs.DirEntry
+	o     fs.Object
+	mode  os.FileMode
+}
+
+func newSnapshotFile(node Node) (*snapshotFile, error) {
+	entry := node.DirEntry()
+	o, _ := entry.(fs.Object)
+	return &snapshotFile{
+		Node:  node,
+		entry: entry,
+		o:     o,
+		mode:  node.Mode(),
+	}, nil
+}
+
+// DirEntry returns the fs.DirEntry captured at snapshot time, not the live
+// Node's. syntheticXattr (in xattr.go) and everything else that reads
+// metadata through this interface therefore sees a frozen view.
+func (sf *snapshotFile) DirEntry() fs.DirEntry { return sf.entry }
+
+// Object returns the fs.Object this snapshot was taken of. Returns nil if
+// the captured DirEntry isn't an fs.Object (shouldn't happen for a non-Dir
+// Node).
+func (sf *snapshotFile) Object() fs.Object { return sf.o }
+
+// Name, Size, ModTime and Mode report the metadata captured at snapshot
+// time rather than falling through to the live Node's os.FileInfo.
+func (sf *snapshotFile) Name() string       { return path.Base(sf.entry.Remote()) }
+func (sf *snapshotFile) Size() int64        { return sf.entry.Size() }
+func (sf *snapshotFile) ModTime() time.Time { return sf.entry.ModTime(context.Background()) }
+func (sf *snapshotFile) Mode() os.FileMode  { return sf.mode }
+
+// SetModTime refuses to modify a snapshot - it is read only.
+func (sf *snapshotFile) SetModTime(modTime time.Time) error {
+	return EROFS
+}
+
+// Remove refuses to modify a snapshot - it is read only.
+func (sf *snapshotFile) Remove() error {
+	return EROFS
+}
+
+// RemoveAll refuses to modify a snapshot - it is read only.
+func (sf *snapshotFile) RemoveAll() error {
+	return EROFS
+}
+
+// Getxattr computes synthetic remote-derived attributes from the frozen
+// DirEntry this snapshot captured, not the live file, so they don't change
+// after the snapshot was taken.
+func (sf *snapshotFile) Getxattr(name string) ([]byte, error) {
+	return xattrGet(sf, name)
+}
+
+// Listxattr lists synthetic attributes resolved against the frozen
+// DirEntry, not the live file.
+func (sf *snapshotFile) Listxattr() ([]string, error) {
+	return xattrList(sf)
+}
+
+// Setxattr refuses to modify a snapshot - it is read only.
+func (sf *snapshotFile) Setxattr(name string, value []byte) error {
+	return EROFS
+}
+
+// Removexattr refuses to modify a snapshot - it is read only.
+func (sf *snapshotFile) Removexattr(name string) error {
+	return EROFS
+}
+
+// snapshotDir is an immutable, point-in-time view of a directory and the
+// listing it had when the snapshot was taken.
+type snapshotDir struct {
+	Node
+	entry    fs.DirEntry
+	mu       sync.Mutex
+	children map[string]Node
+	order    []string
+}
+
+func newSnapshotDir(dir *Dir) (*snapshotDir, error) {
+	entries, err := dir.ReadDirAll()
+	if err != nil {
+		return nil, err
+	}
+	sd := &snapshotDir{
+		Node:     dir,
+		entry:    dir.DirEntry(),
+		children: make(map[string]Node, len(entries)),
+	}
+	for _, entry := range entries {
+		// Dir.Lookup (and therefore snapshotDir.Lookup) is called with
+		// the leaf name, so key the captured listing the same way the
+		// live Dir does rather than by the full remote path.
+		name := path.Base(entry.DirEntry().Remote())
+		child, err := newSnapshotNode(entry)
+		if err != nil {
+			return nil, err
+		}
+		sd.children[name] = child
+		sd.order = append(sd.order, name)
+	}
+	return sd, nil
+}
+
+// DirEntry returns the fs.DirEntry captured at snapshot time, not the live
+// directory's.
+func (sd *snapshotDir) DirEntry() fs.DirEntry { return sd.entry }
+
+// Name, Size and ModTime report the metadata captured at snapshot time
+// rather than falling through to the live Dir's os.FileInfo.
+func (sd *snapshotDir) Name() string       { return path.Base(sd.entry.Remote()) }
+func (sd *snapshotDir) Size() int64        { return sd.entry.Size() }
+func (sd *snapshotDir) ModTime() time.Time { return sd.entry.ModTime(context.Background()) }
+
+// Lookup finds name in the captured listing, not the live directory.
+func (sd *snapshotDir) Lookup(name string) (Node, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	node, ok := sd.children[name]
+	if !ok {
+		return nil, ENOENT
+	}
+	return node, nil
+}
+
+// ReadDirAll returns the directory listing as it was at snapshot time.
+func (sd *snapshotDir) ReadDirAll() (Nodes, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	nodes := make(Nodes, 0, len(sd.order))
+	for _, name := range sd.order {
+		nodes = append(nodes, sd.children[name])
+	}
+	return nodes, nil
+}
+
+// SetModTime refuses to modify a snapshot - it is read only.
+func (sd *snapshotDir) SetModTime(modTime time.Time) error {
+	return EROFS
+}
+
+// Remove refuses to modify a snapshot - it is read only.
+func (sd *snapshotDir) Remove() error {
+	return EROFS
+}
+
+// RemoveAll refuses to modify a snapshot - it is read only.
+func (sd *snapshotDir) RemoveAll() error {
+	return EROFS
+}
+
+// Getxattr computes synthetic remote-derived attributes from the dir entry
+// captured at snapshot time, not the live directory.
+func (sd *snapshotDir) Getxattr(name string) ([]byte, error) {
+	return xattrGet(sd, name)
+}
+
+// Listxattr lists synthetic attributes resolved against the dir entry
+// captured at snapshot time, not the live directory.
+func (sd *snapshotDir) Listxattr() ([]string, error) {
+	return xattrList(sd)
+}
+
+// Setxattr refuses to modify a snapshot - it is read only.
+func (sd *snapshotDir) Setxattr(name string, value []byte) error {
+	return EROFS
+}
+
+// Removexattr refuses to modify a snapshot - it is read only.
+func (sd *snapshotDir) Removexattr(name string) error {
+	return EROFS
+}
+
+var (
+	_ Node = (*snapshotFile)(nil)
+	_ Node = (*snapshotDir)(nil)
+)
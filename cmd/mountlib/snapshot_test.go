@@ -0,0 +1,94 @@
+package mountlib
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/fs/hash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeXattrObject is a minimal fs.Object whose mimetype can be mutated,
+// standing in for a live remote object whose metadata changes after a
+// snapshot has already captured it.
+type fakeXattrObject struct {
+	remote   string
+	mimeType string
+	size     int64
+}
+
+func (o *fakeXattrObject) String() string                        { return o.remote }
+func (o *fakeXattrObject) Remote() string                        { return o.remote }
+func (o *fakeXattrObject) ModTime(ctx context.Context) time.Time { return time.Time{} }
+func (o *fakeXattrObject) Size() int64                           { return o.size }
+func (o *fakeXattrObject) Fs() fs.Info                           { return nil }
+func (o *fakeXattrObject) Hash(ctx context.Context, ty hash.Type) (string, error) {
+	return "", nil
+}
+func (o *fakeXattrObject) Storable() bool                                    { return true }
+func (o *fakeXattrObject) SetModTime(ctx context.Context, t time.Time) error { return nil }
+func (o *fakeXattrObject) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	return nil, nil
+}
+func (o *fakeXattrObject) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	return nil
+}
+func (o *fakeXattrObject) Remove(ctx context.Context) error { return nil }
+func (o *fakeXattrObject) MimeType() string                 { return o.mimeType }
+
+var _ fs.Object = (*fakeXattrObject)(nil)
+
+// fakeXattrFileNode is a minimal Node whose DirEntry can be swapped out,
+// standing in for a *File whose live object changes identity (a new
+// fs.Object from a fresh remote listing) after a write.
+type fakeXattrFileNode struct {
+	fakeNode
+	entry fs.Object
+}
+
+func (n *fakeXattrFileNode) DirEntry() fs.DirEntry { return n.entry }
+
+var _ Node = (*fakeXattrFileNode)(nil)
+
+func TestSnapshotFileGetxattrFrozen(t *testing.T) {
+	obj := &fakeXattrObject{remote: "doc.txt", mimeType: "text/plain"}
+	node := &fakeXattrFileNode{fakeNode: fakeNode{inode: 7, remote: "doc.txt"}, entry: obj}
+
+	snap, err := newSnapshotFile(node)
+	require.NoError(t, err)
+
+	// Overwrite the live node's object with a new instance - simulating a
+	// write that lands between Snapshot() and the first read of the
+	// snapshot - before ever reading through snap.
+	node.entry = &fakeXattrObject{remote: "doc.txt", mimeType: "application/pdf"}
+
+	value, err := snap.Getxattr(xattrMimeType)
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", string(value), "snapshot must not see the live node's later object")
+
+	names, err := snap.Listxattr()
+	require.NoError(t, err)
+	assert.Contains(t, names, xattrMimeType)
+}
+
+// TestSnapshotFileSizeFrozen checks that Size, like Getxattr, reports the
+// metadata captured at snapshot time rather than falling through promotion
+// to the live Node's os.FileInfo.
+func TestSnapshotFileSizeFrozen(t *testing.T) {
+	node := &fakeXattrFileNode{
+		fakeNode: fakeNode{inode: 7, remote: "doc.txt"},
+		entry:    &fakeXattrObject{remote: "doc.txt", size: 100},
+	}
+
+	snap, err := newSnapshotFile(node)
+	require.NoError(t, err)
+
+	node.entry = &fakeXattrObject{remote: "doc.txt", size: 200}
+
+	assert.Equal(t, int64(100), snap.Size())
+	assert.Equal(t, int64(100), snap.DirEntry().Size())
+}
@@ -0,0 +1,114 @@
+package mountlib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+const (
+	statfsBlockSize = 4096
+	// statfsFallbackBlocks is used for backends which don't support
+	// Features().About, so df reports a huge but finite amount of space
+	// rather than claiming to be full or empty.
+	statfsFallbackBlocks = (1 << 50) / statfsBlockSize
+	statfsFallbackFiles  = 1e9
+)
+
+// StatfsCacheTime is how long a Statfs result is cached for before the
+// backend's About is queried again. Set via the --vfs-statfs-cache-time
+// flag.
+var StatfsCacheTime = time.Minute
+
+// StatfsInfo holds file system metadata of the kind returned by the statfs
+// syscall. It is consumed by both the FUSE and NFS mount frontends.
+type StatfsInfo struct {
+	Blocks  uint64 // Total data blocks in file system
+	Bfree   uint64 // Free blocks in file system
+	Bavail  uint64 // Free blocks in file system if you're not root
+	Files   uint64 // Total files in file system
+	Ffree   uint64 // Free files in file system
+	Bsize   uint32 // Block size
+	Namelen uint32 // Maximum file name length
+	Frsize  uint32 // Fragment size, smallest addressable data size in the file system
+}
+
+// statfsCache holds the last StatfsInfo fetched for an FS, so repeated
+// statfs calls (df is often called in a loop) don't hit the backend on
+// every call.
+type statfsCache struct {
+	mu      sync.Mutex
+	info    *StatfsInfo
+	fetched time.Time
+}
+
+// statfs returns cached file system metadata, refreshing it from the
+// backend's Features().About if the cache has expired.
+func (fsys *FS) statfs() (*StatfsInfo, error) {
+	fsys.statfsCache.mu.Lock()
+	defer fsys.statfsCache.mu.Unlock()
+
+	if fsys.statfsCache.info != nil && time.Since(fsys.statfsCache.fetched) < StatfsCacheTime {
+		return fsys.statfsCache.info, nil
+	}
+
+	info := fsys.statfsFallback()
+	doAbout := fsys.f.Features().About
+	if doAbout != nil {
+		usage, err := doAbout()
+		if err != nil {
+			fs.Errorf(fsys.f, "Statfs: About failed: %v", err)
+		} else {
+			if usage.Total != nil {
+				info.Blocks = uint64(*usage.Total) / statfsBlockSize
+				// Bfree/Bavail must never exceed the real total we just
+				// learned, so reset the fallback's huge value before
+				// possibly refining it below.
+				info.Bfree = 0
+				info.Bavail = 0
+			}
+			if usage.Free != nil {
+				info.Bfree = uint64(*usage.Free) / statfsBlockSize
+				info.Bavail = info.Bfree
+			} else if usage.Total != nil && usage.Used != nil {
+				used := *usage.Used
+				if used > *usage.Total {
+					used = *usage.Total
+				}
+				info.Bfree = uint64(*usage.Total-used) / statfsBlockSize
+				info.Bavail = info.Bfree
+			}
+			if usage.Objects != nil {
+				// usage.Objects is the count of objects already stored on
+				// the remote, not a quota of file slots - there's no
+				// reliable total/free-inode count to report from it.
+				// Treat it as the used count and keep reporting the same
+				// fallback headroom of free slots used when About doesn't
+				// expose Objects at all, rather than claiming every file
+				// already on the remote is free.
+				info.Files = uint64(*usage.Objects) + statfsFallbackFiles
+				info.Ffree = statfsFallbackFiles
+			}
+		}
+	}
+
+	fsys.statfsCache.info = info
+	fsys.statfsCache.fetched = time.Now()
+	return info, nil
+}
+
+// statfsFallback returns sensible defaults for backends which don't
+// implement Features().About.
+func (fsys *FS) statfsFallback() *StatfsInfo {
+	return &StatfsInfo{
+		Blocks:  statfsFallbackBlocks,
+		Bfree:   statfsFallbackBlocks,
+		Bavail:  statfsFallbackBlocks,
+		Files:   statfsFallbackFiles,
+		Ffree:   statfsFallbackFiles,
+		Bsize:   statfsBlockSize,
+		Namelen: 255,
+		Frsize:  statfsBlockSize,
+	}
+}
@@ -0,0 +1,96 @@
+package mountlib
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/fs/hash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStatfsFs is a minimal fs.Fs exposing only a configurable About, which
+// is all (fsys *FS).statfs needs from the backend.
+type fakeStatfsFs struct {
+	about func() (*fs.Usage, error)
+}
+
+func (f *fakeStatfsFs) Name() string             { return "fake" }
+func (f *fakeStatfsFs) Root() string             { return "" }
+func (f *fakeStatfsFs) String() string           { return "fake" }
+func (f *fakeStatfsFs) Precision() time.Duration { return time.Second }
+func (f *fakeStatfsFs) Hashes() hash.Set         { return 0 }
+func (f *fakeStatfsFs) Features() *fs.Features   { return &fs.Features{About: f.about} }
+func (f *fakeStatfsFs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
+	return nil, nil
+}
+func (f *fakeStatfsFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	return nil, nil
+}
+func (f *fakeStatfsFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return nil, nil
+}
+func (f *fakeStatfsFs) Mkdir(ctx context.Context, dir string) error { return nil }
+func (f *fakeStatfsFs) Rmdir(ctx context.Context, dir string) error { return nil }
+
+var _ fs.Fs = (*fakeStatfsFs)(nil)
+
+func TestStatfsCache(t *testing.T) {
+	oldCacheTime := StatfsCacheTime
+	StatfsCacheTime = time.Hour
+	defer func() { StatfsCacheTime = oldCacheTime }()
+
+	calls := 0
+	total := int64(1000 * statfsBlockSize)
+	free := int64(400 * statfsBlockSize)
+	fsys := &FS{f: &fakeStatfsFs{about: func() (*fs.Usage, error) {
+		calls++
+		return &fs.Usage{Total: &total, Free: &free}, nil
+	}}}
+
+	info, err := fsys.statfs()
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, uint64(1000), info.Blocks)
+	assert.Equal(t, uint64(400), info.Bfree)
+
+	// A second call within the cache window must be served from cache,
+	// not hit About again.
+	_, err = fsys.statfs()
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	// Once the cache has expired, statfs must refetch from the backend.
+	fsys.statfsCache.fetched = time.Now().Add(-2 * StatfsCacheTime)
+	_, err = fsys.statfs()
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestStatfsObjectsUsedNotFree(t *testing.T) {
+	total := int64(1000 * statfsBlockSize)
+	free := int64(400 * statfsBlockSize)
+	objects := int64(12345)
+	fsys := &FS{f: &fakeStatfsFs{about: func() (*fs.Usage, error) {
+		return &fs.Usage{Total: &total, Free: &free, Objects: &objects}, nil
+	}}}
+
+	info, err := fsys.statfs()
+	require.NoError(t, err)
+	// Objects already stored on the remote must count as used, not free -
+	// Ffree must never equal Files when the remote actually holds content.
+	assert.Equal(t, uint64(objects)+statfsFallbackFiles, info.Files)
+	assert.Equal(t, uint64(statfsFallbackFiles), info.Ffree)
+	assert.NotEqual(t, info.Files, info.Ffree)
+}
+
+func TestStatfsFallback(t *testing.T) {
+	fsys := &FS{f: &fakeStatfsFs{about: nil}}
+
+	info, err := fsys.statfs()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(statfsFallbackBlocks), info.Blocks)
+}
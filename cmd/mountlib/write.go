@@ -0,0 +1,84 @@
+package mountlib
+
+import (
+	"fmt"
+)
+
+// WriteFileHandle is returned from a *File opened for writing. It buffers
+// writes (journaling them for crash recovery when a write-back journal is
+// configured - see journal.go) and uploads the whole file to the remote
+// once the handle is flushed/closed.
+type WriteFileHandle struct {
+	file *File
+	fsys *FS
+}
+
+// newWriteFileHandle creates a WriteFileHandle for file and registers it
+// with the write-back journal so every subsequent Write is recorded and
+// can be replayed if rclone crashes before Flush uploads it. Backends call
+// this from their open-for-write/create path.
+func newWriteFileHandle(fsys *FS, file *File) *WriteFileHandle {
+	wfh := &WriteFileHandle{file: file, fsys: fsys}
+	fsys.journalBegin(wfh, file)
+	return wfh
+}
+
+// OpenWrite opens f for writing, returning a WriteFileHandle whose writes
+// are buffered and journaled by fsys.
+func (f *File) OpenWrite(fsys *FS) *WriteFileHandle {
+	return newWriteFileHandle(fsys, f)
+}
+
+// Write buffers len(p) bytes at offset, recording them in the write-back
+// journal before returning so they survive a crash before the eventual
+// upload.
+func (wfh *WriteFileHandle) Write(p []byte, offset int64) (n int, err error) {
+	return wfh.JournalWrite(p, offset)
+}
+
+// Flush uploads everything buffered so far to the remote and marks the
+// write-back journal entry for this file done. It is safe to call more
+// than once; subsequent calls are a no-op once the handle has been
+// deregistered.
+func (wfh *WriteFileHandle) Flush() error {
+	writebackMu.Lock()
+	state, ok := writebackStates[wfh]
+	writebackMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if state.spill != "" {
+		data, err := readSpill(state.spill, state.highWater)
+		if err != nil {
+			return err
+		}
+		if err := uploadSpill(wfh.fsys, wfh.file.DirEntry().Remote(), data); err != nil {
+			return err
+		}
+	}
+	return wfh.JournalClose()
+}
+
+// Release is called once the kernel has no further references to the
+// handle. Any frontend that didn't already call Flush (for example on an
+// error path) must still do so here to avoid leaking the spill file and
+// journal entry.
+func (wfh *WriteFileHandle) Release() error {
+	return wfh.Flush()
+}
+
+// String returns a description of wfh for logging.
+func (wfh *WriteFileHandle) String() string {
+	if wfh == nil || wfh.file == nil {
+		return "<nil *WriteFileHandle>"
+	}
+	return fmt.Sprintf("%s (write)", wfh.file.String())
+}
+
+// Node returns the File this handle was opened on.
+func (wfh *WriteFileHandle) Node() Node {
+	return wfh.file
+}
+
+var _ Noder = (*WriteFileHandle)(nil)
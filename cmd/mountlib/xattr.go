@@ -0,0 +1,214 @@
+package mountlib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// xattrNamespace is the namespace rclone publishes synthetic,
+// remote-derived metadata under, so it can live alongside user-set
+// attributes without colliding with them.
+const xattrNamespace = "user.rclone."
+
+// Synthetic attribute names exposed read-only under xattrNamespace. Their
+// values are derived from the Node's DirEntry rather than stored.
+const (
+	xattrHash          = xattrNamespace + "hash"
+	xattrMimeType      = xattrNamespace + "mimetype"
+	xattrStorageClass  = xattrNamespace + "storage-class"
+	xattrModTimeSource = xattrNamespace + "modtime-source"
+	xattrUploadID      = xattrNamespace + "upload-id"
+)
+
+var allSyntheticXattrs = []string{xattrHash, xattrMimeType, xattrStorageClass, xattrModTimeSource, xattrUploadID}
+
+// Getxattr returns the value of the named extended attribute for d. Names
+// under xattrNamespace are synthesised from the remote's metadata and are
+// read-only; any other name is looked up in the per-inode store.
+func (d *Dir) Getxattr(name string) ([]byte, error) { return xattrGet(d, name) }
+
+// Setxattr sets the named extended attribute on d to value. Attributes
+// under xattrNamespace are synthetic and read-only.
+func (d *Dir) Setxattr(name string, value []byte) error { return xattrSet(d, name, value) }
+
+// Listxattr returns the names of all extended attributes set on d,
+// including any synthetic user.rclone.* attributes that actually resolve.
+func (d *Dir) Listxattr() ([]string, error) { return xattrList(d) }
+
+// Removexattr removes the named extended attribute from d. Attributes
+// under xattrNamespace are synthetic and read-only.
+func (d *Dir) Removexattr(name string) error { return xattrRemove(d, name) }
+
+// Getxattr returns the value of the named extended attribute for f. Names
+// under xattrNamespace are synthesised from the remote's metadata and are
+// read-only; any other name is looked up in the per-inode store.
+func (f *File) Getxattr(name string) ([]byte, error) { return xattrGet(f, name) }
+
+// Setxattr sets the named extended attribute on f to value. Attributes
+// under xattrNamespace are synthetic and read-only.
+func (f *File) Setxattr(name string, value []byte) error { return xattrSet(f, name, value) }
+
+// Listxattr returns the names of all extended attributes set on f,
+// including any synthetic user.rclone.* attributes that actually resolve.
+func (f *File) Listxattr() ([]string, error) { return xattrList(f) }
+
+// Removexattr removes the named extended attribute from f. Attributes
+// under xattrNamespace are synthetic and read-only.
+func (f *File) Removexattr(name string) error { return xattrRemove(f, name) }
+
+// xattrStore is a process-wide, inode-keyed backing store for
+// user-settable extended attributes. The synthetic user.rclone.* namespace
+// is computed on the fly and never stored here.
+type xattrStore struct {
+	mu    sync.Mutex
+	attrs map[uint64]map[string][]byte
+}
+
+var defaultXattrStore = &xattrStore{
+	attrs: make(map[uint64]map[string][]byte),
+}
+
+// xattrGet implements Getxattr for both Dir and File.
+func xattrGet(node Node, name string) ([]byte, error) {
+	if isSyntheticXattr(name) {
+		value, ok := syntheticXattr(node, name)
+		if !ok {
+			return nil, ENOATTR
+		}
+		return value, nil
+	}
+	defaultXattrStore.mu.Lock()
+	defer defaultXattrStore.mu.Unlock()
+	value, ok := defaultXattrStore.attrs[node.Inode()][name]
+	if !ok {
+		return nil, ENOATTR
+	}
+	return value, nil
+}
+
+// xattrSet implements Setxattr for both Dir and File.
+func xattrSet(node Node, name string, value []byte) error {
+	if isSyntheticXattr(name) {
+		return EROFS
+	}
+	defaultXattrStore.mu.Lock()
+	defer defaultXattrStore.mu.Unlock()
+	inode := node.Inode()
+	if defaultXattrStore.attrs[inode] == nil {
+		defaultXattrStore.attrs[inode] = make(map[string][]byte)
+	}
+	defaultXattrStore.attrs[inode][name] = append([]byte(nil), value...)
+	return nil
+}
+
+// xattrList implements Listxattr for both Dir and File. Synthetic names
+// are only advertised when they actually resolve to a value, so
+// `getfattr` doesn't list attributes that would fail to read.
+func xattrList(node Node) ([]string, error) {
+	var names []string
+	for _, name := range allSyntheticXattrs {
+		if _, ok := syntheticXattr(node, name); ok {
+			names = append(names, name)
+		}
+	}
+	defaultXattrStore.mu.Lock()
+	for name := range defaultXattrStore.attrs[node.Inode()] {
+		names = append(names, name)
+	}
+	defaultXattrStore.mu.Unlock()
+	sort.Strings(names)
+	return names, nil
+}
+
+// xattrRemove implements Removexattr for both Dir and File.
+func xattrRemove(node Node, name string) error {
+	if isSyntheticXattr(name) {
+		return EROFS
+	}
+	defaultXattrStore.mu.Lock()
+	defer defaultXattrStore.mu.Unlock()
+	inode := node.Inode()
+	if _, ok := defaultXattrStore.attrs[inode][name]; !ok {
+		return ENOATTR
+	}
+	delete(defaultXattrStore.attrs[inode], name)
+	return nil
+}
+
+// isSyntheticXattr reports whether name is one of the read-only
+// remote-derived attributes under xattrNamespace.
+func isSyntheticXattr(name string) bool {
+	switch name {
+	case xattrHash, xattrMimeType, xattrStorageClass, xattrModTimeSource, xattrUploadID:
+		return true
+	default:
+		return false
+	}
+}
+
+// syntheticXattr computes the value of a user.rclone.* attribute from
+// node's DirEntry. ok is false if name isn't a known synthetic attribute,
+// or the underlying remote/object doesn't expose the information needed
+// to answer it.
+func syntheticXattr(node Node, name string) (value []byte, ok bool) {
+	entry := node.DirEntry()
+	if entry == nil {
+		return nil, false
+	}
+	switch name {
+	case xattrHash:
+		o, isObject := entry.(fs.Object)
+		if !isObject {
+			return nil, false
+		}
+		info := o.Fs()
+		if info == nil {
+			return nil, false
+		}
+		ht := info.Hashes().GetOne()
+		if ht == 0 {
+			return nil, false
+		}
+		sum, err := o.Hash(context.Background(), ht)
+		if err != nil || sum == "" {
+			return nil, false
+		}
+		return []byte(fmt.Sprintf("%s:%s", ht, sum)), true
+	case xattrMimeType:
+		do, isMimer := entry.(interface{ MimeType() string })
+		if !isMimer {
+			return nil, false
+		}
+		mimeType := do.MimeType()
+		if mimeType == "" {
+			return nil, false
+		}
+		return []byte(mimeType), true
+	case xattrStorageClass:
+		// Only some backends (e.g. s3, gcs) expose the actual storage
+		// class (STANDARD, GLACIER, NEARLINE, ...) of an object; fall
+		// back to omitting the attribute rather than advertise something
+		// that isn't really a storage class.
+		do, isStorageClasser := entry.(interface{ StorageClass() string })
+		if !isStorageClasser {
+			return nil, false
+		}
+		storageClass := do.StorageClass()
+		if storageClass == "" {
+			return nil, false
+		}
+		return []byte(storageClass), true
+	case xattrModTimeSource:
+		return []byte("remote"), true
+	case xattrUploadID:
+		// No backend's upload ID is read here, so this attribute never
+		// resolves and Listxattr never lists it.
+		return nil, false
+	default:
+		return nil, false
+	}
+}
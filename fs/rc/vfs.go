@@ -0,0 +1,175 @@
+package rc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// VFS is implemented by a running mount's FS (for example mountlib.FS) so
+// it can be introspected and controlled over the rc interface without
+// fs/rc depending on the mount packages.
+type VFS interface {
+	// VFSStats returns a snapshot of cache/handle/writeback counters.
+	VFSStats() VFSStats
+	// ForgetPath drops the in-process dir cache entry for path.
+	ForgetPath(path string)
+	// Refresh re-reads the directory listing for path from the remote.
+	Refresh(path string) error
+	// PollNow triggers an immediate out-of-band poll sweep.
+	PollNow() error
+}
+
+// VFSStats is a snapshot of a mounted VFS's internal counters, returned by
+// the vfs/stats rc call.
+type VFSStats struct {
+	CacheSize        int64     `json:"cacheSize"`             // bytes held in the local cache
+	OpenHandles      int       `json:"openHandles"`           // number of open read/write file handles
+	DirCacheEntries  int       `json:"dirCacheEntries"`       // number of cached directory listings
+	PendingWriteback int64     `json:"pendingWritebackBytes"` // bytes buffered waiting to be uploaded
+	LastPoll         time.Time `json:"lastPoll"`              // time of the last successful change poll
+}
+
+var (
+	vfsRegistryMu sync.Mutex
+	vfsRegistry   = map[string]VFS{}
+)
+
+// AddVFS registers a running mount's VFS under name so it is visible to
+// the vfs/* rc calls. Mount backends call this from their setup code and
+// RemoveVFS when they unmount.
+func AddVFS(name string, vfs VFS) {
+	vfsRegistryMu.Lock()
+	defer vfsRegistryMu.Unlock()
+	vfsRegistry[name] = vfs
+}
+
+// RemoveVFS deregisters the VFS previously added with AddVFS.
+func RemoveVFS(name string) {
+	vfsRegistryMu.Lock()
+	defer vfsRegistryMu.Unlock()
+	delete(vfsRegistry, name)
+}
+
+// getVFSNamed resolves the VFS named by the "fs" param, following the same
+// Params conventions as GetFsNamed.
+func getVFSNamed(in Params, key string) (VFS, error) {
+	name, err := in.GetString(key)
+	if err != nil {
+		return nil, err
+	}
+	vfsRegistryMu.Lock()
+	vfs, ok := vfsRegistry[name]
+	vfsRegistryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("didn't find mount %q", name)
+	}
+	return vfs, nil
+}
+
+// optionalDir returns the "dir" param if set, or "" if it was omitted.
+func optionalDir(in Params) string {
+	dir, _ := in["dir"].(string)
+	return dir
+}
+
+func init() {
+	Add(Call{
+		Path:  "vfs/list-mounts",
+		Fn:    rcListMounts,
+		Title: "List the currently mounted VFSes",
+		Help: `This lists the currently active mounts known to the vfs/*
+rc calls, as a list of the names they were mounted under.`,
+	})
+	Add(Call{
+		Path:  "vfs/stats",
+		Fn:    rcVFSStats,
+		Title: "Return cache/handle/writeback stats for a mount",
+		Help: `This takes the following parameters
+
+- fs - name of the mount as returned by vfs/list-mounts
+
+and returns cache size, open handle count, dir cache entries,
+pending writeback bytes and the time of the last poll.`,
+	})
+	Add(Call{
+		Path:  "vfs/forget",
+		Fn:    rcVFSForget,
+		Title: "Forget the dir cache for a path under a mount",
+		Help: `This takes the following parameters
+
+- fs - name of the mount as returned by vfs/list-mounts
+- dir - path to forget (optional, forgets the whole tree if omitted)`,
+	})
+	Add(Call{
+		Path:  "vfs/refresh",
+		Fn:    rcVFSRefresh,
+		Title: "Refresh the dir cache for a path under a mount",
+		Help: `This takes the following parameters
+
+- fs - name of the mount as returned by vfs/list-mounts
+- dir - path to refresh (optional, refreshes the root if omitted)`,
+	})
+	Add(Call{
+		Path:  "vfs/poll-now",
+		Fn:    rcVFSPollNow,
+		Title: "Trigger an immediate PollChanges sweep on a mount",
+		Help: `This takes the following parameters
+
+- fs - name of the mount as returned by vfs/list-mounts
+
+and triggers an immediate out-of-band change poll instead of waiting
+for the next scheduled one. It does not change the mount's configured
+poll interval.`,
+	})
+}
+
+func rcListMounts(ctx context.Context, in Params) (out Params, err error) {
+	vfsRegistryMu.Lock()
+	names := make([]string, 0, len(vfsRegistry))
+	for name := range vfsRegistry {
+		names = append(names, name)
+	}
+	vfsRegistryMu.Unlock()
+	return Params{"mounts": names}, nil
+}
+
+func rcVFSStats(ctx context.Context, in Params) (out Params, err error) {
+	vfs, err := getVFSNamed(in, "fs")
+	if err != nil {
+		return nil, err
+	}
+	return Params{"stats": vfs.VFSStats()}, nil
+}
+
+func rcVFSForget(ctx context.Context, in Params) (out Params, err error) {
+	vfs, err := getVFSNamed(in, "fs")
+	if err != nil {
+		return nil, err
+	}
+	vfs.ForgetPath(optionalDir(in))
+	return Params{}, nil
+}
+
+func rcVFSRefresh(ctx context.Context, in Params) (out Params, err error) {
+	vfs, err := getVFSNamed(in, "fs")
+	if err != nil {
+		return nil, err
+	}
+	if err := vfs.Refresh(optionalDir(in)); err != nil {
+		return nil, err
+	}
+	return Params{}, nil
+}
+
+func rcVFSPollNow(ctx context.Context, in Params) (out Params, err error) {
+	vfs, err := getVFSNamed(in, "fs")
+	if err != nil {
+		return nil, err
+	}
+	if err := vfs.PollNow(); err != nil {
+		return nil, err
+	}
+	return Params{}, nil
+}
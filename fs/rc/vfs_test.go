@@ -0,0 +1,87 @@
+package rc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockVFS struct {
+	forgotten string
+	refreshed string
+	polled    bool
+}
+
+func (m *mockVFS) VFSStats() VFSStats {
+	return VFSStats{CacheSize: 42, OpenHandles: 1, LastPoll: time.Unix(0, 0)}
+}
+func (m *mockVFS) ForgetPath(path string) { m.forgotten = path }
+func (m *mockVFS) Refresh(path string) error {
+	m.refreshed = path
+	return nil
+}
+func (m *mockVFS) PollNow() error {
+	m.polled = true
+	return nil
+}
+
+func mockAddVFS(t *testing.T) (*mockVFS, func()) {
+	vfs := &mockVFS{}
+	AddVFS("potato", vfs)
+	return vfs, func() {
+		RemoveVFS("potato")
+	}
+}
+
+func TestRcListMounts(t *testing.T) {
+	_, cleanup := mockAddVFS(t)
+	defer cleanup()
+
+	out, err := rcListMounts(context.Background(), Params{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"potato"}, out["mounts"])
+}
+
+func TestRcVFSStats(t *testing.T) {
+	_, cleanup := mockAddVFS(t)
+	defer cleanup()
+
+	out, err := rcVFSStats(context.Background(), Params{"fs": "potato"})
+	require.NoError(t, err)
+	stats, ok := out["stats"].(VFSStats)
+	require.True(t, ok)
+	assert.Equal(t, int64(42), stats.CacheSize)
+
+	_, err = rcVFSStats(context.Background(), Params{"fs": "sausage"})
+	require.Error(t, err)
+}
+
+func TestRcVFSForget(t *testing.T) {
+	vfs, cleanup := mockAddVFS(t)
+	defer cleanup()
+
+	_, err := rcVFSForget(context.Background(), Params{"fs": "potato", "dir": "a/b"})
+	require.NoError(t, err)
+	assert.Equal(t, "a/b", vfs.forgotten)
+}
+
+func TestRcVFSRefresh(t *testing.T) {
+	vfs, cleanup := mockAddVFS(t)
+	defer cleanup()
+
+	_, err := rcVFSRefresh(context.Background(), Params{"fs": "potato"})
+	require.NoError(t, err)
+	assert.Equal(t, "", vfs.refreshed)
+}
+
+func TestRcVFSPollNow(t *testing.T) {
+	vfs, cleanup := mockAddVFS(t)
+	defer cleanup()
+
+	_, err := rcVFSPollNow(context.Background(), Params{"fs": "potato"})
+	require.NoError(t, err)
+	assert.True(t, vfs.polled)
+}